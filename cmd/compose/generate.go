@@ -17,20 +17,223 @@
 package compose
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/compose-spec/compose-go/v2/loader"
 	"github.com/compose-spec/compose-go/v2/types"
 	"github.com/docker/cli/cli/command"
 	"github.com/docker/compose/v2/pkg/api"
 	engineTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/spf13/cobra"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubeyaml "sigs.k8s.io/yaml"
 )
 
+// defaultNetworkNames are the implicit per-engine networks that don't carry
+// any user intent and therefore shouldn't be promoted to the compose file.
+var defaultNetworkNames = map[string]bool{
+	"bridge": true,
+	"host":   true,
+	"none":   true,
+}
+
 type generateOptions struct {
 	*ProjectOptions
+	Format      string
+	Output      string
+	Merge       bool
+	DryRun      bool
+	FromRunning bool
+	All         bool
+	Filters     []string
+}
+
+// containerRelations is what we were able to infer about how one container
+// relates to the others passed to `generate`, so it can be threaded onto the
+// corresponding ServiceConfig.
+type containerRelations struct {
+	Links       []string
+	DependsOn   types.DependsOnConfig
+	NetworkMode string
+	VolumesFrom []string
+}
+
+// containerGroup inspects containers on demand and remembers them by every
+// name we might see them referenced by (ID, short ID, container name), so
+// that containers pulled in via --link/--network-mode/--volumes-from that
+// weren't passed on the CLI only get inspected once and still get a stable
+// service name.
+type containerGroup struct {
+	ctx       context.Context
+	dockerCli command.Cli
+
+	containers   map[string]engineTypes.ContainerJSON // keyed by full container ID
+	ids          map[string]string                    // any ref we've seen (ID, short ID, name, as originally passed) -> full container ID
+	serviceNames map[string]string                    // full container ID -> compose service name
+	order        []string                             // full container IDs, in first-seen order
+}
+
+func newContainerGroup(ctx context.Context, dockerCli command.Cli) *containerGroup {
+	return &containerGroup{
+		ctx:          ctx,
+		dockerCli:    dockerCli,
+		containers:   map[string]engineTypes.ContainerJSON{},
+		ids:          map[string]string{},
+		serviceNames: map[string]string{},
+	}
+}
+
+// inspect returns the container for ref, inspecting and registering it the
+// first time it's seen. Containers referenced but not passed on the CLI
+// (e.g. the target of a --link) are picked up here too.
+func (g *containerGroup) inspect(ref string) (engineTypes.ContainerJSON, error) {
+	if id, ok := g.ids[ref]; ok {
+		return g.containers[id], nil
+	}
+
+	container, err := g.dockerCli.Client().ContainerInspect(g.ctx, ref)
+	if err != nil {
+		return container, err
+	}
+
+	g.containers[container.ID] = container
+	g.ids[ref] = container.ID
+	g.ids[container.ID] = container.ID
+	if len(container.ID) > 12 {
+		g.ids[container.ID[:12]] = container.ID
+	}
+	g.ids[strings.TrimPrefix(container.Name, "/")] = container.ID
+	g.serviceNames[container.ID] = getServiceName(container, len(g.order))
+	g.order = append(g.order, container.ID)
+
+	return container, nil
+}
+
+// resolveRelations reads the relationships that aren't already visible in a
+// single container's own compose service (links, shared network namespace,
+// shared volumes), inspecting any referenced container that wasn't passed on
+// the CLI as it goes.
+func (g *containerGroup) resolveRelations(c engineTypes.ContainerJSON) (containerRelations, error) {
+	rel := containerRelations{DependsOn: types.DependsOnConfig{}}
+	name := g.serviceNames[c.ID]
+
+	for _, link := range c.HostConfig.Links {
+		// links are reported as "/<source>:/<this-container>/<alias>"
+		parts := strings.SplitN(link, ":", 2)
+		ref := strings.TrimPrefix(parts[0], "/")
+		target, err := g.inspect(ref)
+		if err != nil {
+			return rel, fmt.Errorf("container %q links to %q, which could not be found: %w", name, ref, err)
+		}
+		targetName := g.serviceNames[target.ID]
+		linkName := targetName
+		if len(parts) == 2 {
+			if alias := path.Base(parts[1]); alias != targetName {
+				// carry the alias along, e.g. "db:database"
+				linkName = fmt.Sprintf("%s:%s", targetName, alias)
+			}
+		}
+		rel.Links = append(rel.Links, linkName)
+		rel.DependsOn[targetName] = types.ServiceDependency{Condition: types.ServiceConditionStarted, Required: true}
+	}
+
+	if mode := string(c.HostConfig.NetworkMode); strings.HasPrefix(mode, "container:") {
+		ref := strings.TrimPrefix(mode, "container:")
+		target, err := g.inspect(ref)
+		if err != nil {
+			return rel, fmt.Errorf("container %q shares its network with %q, which could not be found: %w", name, ref, err)
+		}
+		targetName := g.serviceNames[target.ID]
+		rel.NetworkMode = "service:" + targetName
+		rel.DependsOn[targetName] = types.ServiceDependency{Condition: types.ServiceConditionStarted, Required: true}
+	}
+
+	for _, vf := range c.HostConfig.VolumesFrom {
+		parts := strings.SplitN(vf, ":", 2)
+		target, err := g.inspect(parts[0])
+		if err != nil {
+			return rel, fmt.Errorf("container %q mounts volumes from %q, which could not be found: %w", name, parts[0], err)
+		}
+		targetName := g.serviceNames[target.ID]
+		if len(parts) == 2 {
+			// carry the ro/rw mode along, e.g. "db:ro"
+			targetName = fmt.Sprintf("%s:%s", targetName, parts[1])
+		}
+		rel.VolumesFrom = append(rel.VolumesFrom, targetName)
+		rel.DependsOn[g.serviceNames[target.ID]] = types.ServiceDependency{Condition: types.ServiceConditionStarted, Required: true}
+	}
+
+	if len(rel.DependsOn) == 0 {
+		rel.DependsOn = nil
+	}
+
+	return rel, nil
+}
+
+// inferNetworkDependencies makes containers that were passed on the CLI and
+// share a user-defined network with an earlier one depend on it too. There's
+// no inherent ordering between them, so "earlier" just means "inspected
+// first" (i.e. appeared first in args).
+func (g *containerGroup) inferNetworkDependencies(args []string, relations map[string]containerRelations) {
+	type member struct {
+		id       string
+		networks map[string]bool
+	}
+
+	var members []member
+	for _, arg := range args {
+		id, ok := g.ids[arg]
+		if !ok {
+			continue
+		}
+		container := g.containers[id]
+		if container.NetworkSettings == nil {
+			continue
+		}
+		nets := map[string]bool{}
+		for name := range container.NetworkSettings.Networks {
+			if !defaultNetworkNames[name] {
+				nets[name] = true
+			}
+		}
+		members = append(members, member{id: id, networks: nets})
+	}
+
+	for i, later := range members {
+		for _, earlier := range members[:i] {
+			if !sharesNetwork(later.networks, earlier.networks) {
+				continue
+			}
+			rel := relations[later.id]
+			if rel.DependsOn == nil {
+				rel.DependsOn = types.DependsOnConfig{}
+			}
+			rel.DependsOn[g.serviceNames[earlier.id]] = types.ServiceDependency{Condition: types.ServiceConditionStarted, Required: true}
+			relations[later.id] = rel
+		}
+	}
+}
+
+func sharesNetwork(a, b map[string]bool) bool {
+	for name := range a {
+		if b[name] {
+			return true
+		}
+	}
+	return false
 }
 
 func generateCommand(p *ProjectOptions, dockerCli command.Cli, backend api.Service) *cobra.Command {
@@ -44,41 +247,163 @@ func generateCommand(p *ProjectOptions, dockerCli command.Cli, backend api.Servi
 		RunE: Adapt(func(ctx context.Context, args []string) error {
 			return runGenerate(ctx, dockerCli, backend, &opts, args)
 		}),
-		Args: cobra.MinimumNArgs(1),
+		// container IDs/names are only required without --from-running,
+		// which is validated in runGenerate since it depends on a flag value
+		Args: cobra.ArbitraryArgs,
 	}
-	// Flags for this command get defined here (and added to &opts) with:
-	// flags := cmd.Flags()
-	// flags.StringVar(...)
-	// flags.BoolVar(...)
+	flags := cmd.Flags()
+	flags.StringVar(&opts.Format, "format", "yaml", `Format to emit: "yaml", "json", or "kube" (Kubernetes Pod/Deployment + Service manifests)`)
+	flags.StringVarP(&opts.Output, "output", "o", "", "Write the generated configuration to FILE instead of stdout")
+	flags.BoolVar(&opts.Merge, "merge", false, "Merge into the existing file at --output instead of overwriting it, preserving hand-authored fields")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Print a diff of what --output would change, without writing it")
+	flags.BoolVar(&opts.FromRunning, "from-running", false, "Select containers with --filter instead of passing IDs/names")
+	flags.BoolVar(&opts.All, "all", false, "Include stopped containers when using --from-running")
+	flags.StringArrayVar(&opts.Filters, "filter", nil, `Filter for --from-running, in "docker ps" syntax, e.g. "label=com.docker.compose.project=foo" or "network=mynet"`)
 
 	return cmd
 }
 
+// parseFilters turns a list of --filter KEY=VALUE strings into the filter
+// args accepted by the Docker API, rejecting anything that isn't KEY=VALUE.
+func parseFilters(raw []string) (filters.Args, error) {
+	filterArgs := filters.NewArgs()
+	for _, filter := range raw {
+		key, value, ok := strings.Cut(filter, "=")
+		if !ok {
+			return filters.Args{}, fmt.Errorf("invalid --filter %q: expected KEY=VALUE", filter)
+		}
+		filterArgs.Add(key, value)
+	}
+	return filterArgs, nil
+}
+
+// selectRunningContainers resolves --from-running/--filter/--all into a list
+// of container IDs, mirroring `docker ps` filter semantics so a whole stack
+// deployed via `docker run` scripts can be recovered with one command.
+func selectRunningContainers(ctx context.Context, dockerCli command.Cli, opts *generateOptions) ([]string, error) {
+	filterArgs, err := parseFilters(opts.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := dockerCli.Client().ContainerList(ctx, engineTypes.ContainerListOptions{
+		Filters: filterArgs,
+		All:     opts.All,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("no containers matched the given --filter(s)")
+	}
+
+	ids := make([]string, 0, len(containers))
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+	}
+	return ids, nil
+}
+
 func runGenerate(ctx context.Context, dockerCli command.Cli, backend api.Service, opts *generateOptions, args []string) error {
 	_, _ = fmt.Fprintln(os.Stderr, "generate command is EXPERIMENTAL ...and it's running ☞ ☁︎ ☀︎")
 
+	if opts.Merge && opts.Output == "" {
+		return fmt.Errorf("--merge requires --output")
+	}
+	if opts.DryRun && opts.Output == "" {
+		return fmt.Errorf("--dry-run requires --output")
+	}
+
+	if opts.FromRunning {
+		if len(args) > 0 {
+			return fmt.Errorf("--from-running selects its own containers via --filter, and can't be combined with container IDs/names")
+		}
+		selected, err := selectRunningContainers(ctx, dockerCli, opts)
+		if err != nil {
+			return err
+		}
+		args = selected
+	} else {
+		if len(opts.Filters) > 0 {
+			return fmt.Errorf("--filter requires --from-running")
+		}
+		if opts.All {
+			return fmt.Errorf("--all requires --from-running")
+		}
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("requires at least 1 container ID/name, or --from-running")
+	}
+
 	projectName := getName(opts)
 	workingDir := getWorkingDir(opts)
 	services := map[string]types.ServiceConfig{}
+	volumes := map[string]types.VolumeConfig{}
+	networks := map[string]types.NetworkConfig{}
+
+	group := newContainerGroup(ctx, dockerCli)
+
+	// First, inspect everything the user passed on the CLI directly (or
+	// that --from-running's filters resolved to).
+	for _, arg := range args {
+		if _, err := group.inspect(arg); err != nil {
+			fmt.Printf("failed to inspect container: %v", err)
+			return err
+		}
+	}
+
+	// Then walk links/network-mode/volumes-from, pulling in any container
+	// that's referenced but wasn't passed on the CLI -- this grows
+	// group.order as it goes, so the loop bound is re-read every iteration.
+	relations := map[string]containerRelations{}
+	for i := 0; i < len(group.order); i++ {
+		container := group.containers[group.order[i]]
+		rel, err := group.resolveRelations(container)
+		if err != nil {
+			return err
+		}
+		relations[container.ID] = rel
+	}
+
+	// Containers that share a user-defined network with another container
+	// the user passed on the CLI should start after it -- there's no
+	// intrinsic order, so we just depend on whichever was inspected first.
+	group.inferNetworkDependencies(args, relations)
 
 	// This is what we're doing approximately!
 	//  => Get the `docker inspect` output from that container
 	//  => Translate that data to compose config
-	for i, arg := range args {
-		container, err := dockerCli.Client().ContainerInspect(ctx, arg)
+	for _, id := range group.order {
+		container := group.containers[id]
+		name := group.serviceNames[id]
+
+		// the image carries its own entrypoint/cmd/env/expose/etc, so only
+		// emit them on the service when the container actually overrides
+		// them -- otherwise every generated file repeats the image defaults
+		imgDefaults, err := getImageDefaults(ctx, dockerCli, container)
 		if err != nil {
-			fmt.Printf("failed to inspect container: %v", err)
-			return err
+			fmt.Fprintf(os.Stderr, "warning: failed to inspect image for %s, will emit its config unconditionally: %v\n", name, err)
+		}
+
+		ports, expose := getServiceBindingsPorts(container, imgDefaults)
+		environment := getServiceEnv(container, imgDefaults)
+		entrypoint := getServiceEntrypoint(container, imgDefaults)
+		serviceVolumes, namedVolumes := getServiceMounts(ctx, dockerCli, container)
+		serviceNetworks, containerNetworks := getServiceNetworks(ctx, dockerCli, container)
+
+		// promote anything named/shared to the top level of the project,
+		// so services can reference them instead of repeating themselves
+		for volumeName, volume := range namedVolumes {
+			volumes[volumeName] = volume
+		}
+		for networkName, network := range containerNetworks {
+			networks[networkName] = network
 		}
-		name := getServiceName(container, i)
-		ports, expose := getServiceBindingsPorts(container)
-		environment := getServiceEnv(container)
-		entrypoint := getServiceEntrypoint(container)
-		volumes := getServiceMounts(container)
 
 		// LOL
 		image := getServiceImage(container)
 
+		rel := relations[id]
 		service := types.ServiceConfig{
 			Name:        name,
 			Image:       image,
@@ -86,10 +411,28 @@ func runGenerate(ctx context.Context, dockerCli command.Cli, backend api.Service
 			Expose:      expose,
 			Entrypoint:  entrypoint,
 			Ports:       ports,
-			Volumes:     volumes,
+			Volumes:     serviceVolumes,
+			Networks:    serviceNetworks,
+			Links:       rel.Links,
+			DependsOn:   rel.DependsOn,
+			NetworkMode: rel.NetworkMode,
+			VolumesFrom: rel.VolumesFrom,
+			WorkingDir:  diffString(container.Config.WorkingDir, imgDefaults.WorkingDir),
+			User:        diffString(container.Config.User, imgDefaults.User),
+			Labels:      diffLabels(container.Config.Labels, imgDefaults.Labels),
+			Hostname:    container.Config.Hostname,
+			HealthCheck: getServiceHealthcheck(container),
+			Restart:     string(container.HostConfig.RestartPolicy.Name),
+			Privileged:  container.HostConfig.Privileged,
+			CapAdd:      container.HostConfig.CapAdd,
+			CapDrop:     container.HostConfig.CapDrop,
+			Devices:     getServiceDevices(container),
+			Ulimits:     getServiceUlimits(container),
+			Sysctls:     types.Mapping(container.HostConfig.Sysctls),
+			Logging:     getServiceLogging(container),
 		}
 
-		cmd := getServiceCmd(container)
+		cmd := getServiceCmd(container, imgDefaults)
 		if len(cmd) > 0 {
 			service.Command = cmd
 		}
@@ -105,17 +448,187 @@ func runGenerate(ctx context.Context, dockerCli command.Cli, backend api.Service
 		Name:       projectName,
 		WorkingDir: workingDir,
 		Services:   services,
+		Volumes:    volumes,
+		Networks:   networks,
+	}
+
+	if opts.Merge {
+		if existing, err := loadProjectFile(opts.Output); err == nil {
+			p = mergeProjects(*existing, p)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to load %s to merge into: %w", opts.Output, err)
+		}
 	}
 
-	yaml, err := p.MarshalYAML()
+	out, err := formatProject(p, opts.Format)
 	if err != nil {
-		fmt.Printf("oops bad %v", err)
+		return err
 	}
-	fmt.Printf("\n%s", string(yaml))
+
+	if opts.DryRun {
+		// a missing file just means --output would be creating it fresh --
+		// diff against an empty "before"
+		before, err := os.ReadFile(opts.Output)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read %s: %w", opts.Output, err)
+		}
+		fmt.Print(unifiedDiff(opts.Output, before, out))
+		return nil
+	}
+
+	if opts.Output == "" {
+		fmt.Printf("\n%s", string(out))
+		return nil
+	}
+
+	if err := os.WriteFile(opts.Output, out, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", opts.Output, err)
+	}
+	fmt.Printf("Wrote %s\n", opts.Output)
 
 	return nil
 }
 
+// loadProjectFile parses an existing compose file via compose-go so --merge
+// can fold newly-generated services/volumes/networks into it.
+func loadProjectFile(path string) (*types.Project, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return loader.LoadWithContext(context.Background(), types.ConfigDetails{
+		WorkingDir:  filepath.Dir(path),
+		ConfigFiles: []types.ConfigFile{{Filename: path, Content: content}},
+	}, func(o *loader.Options) {
+		o.SkipValidation = true
+		o.SkipConsistencyCheck = true
+	})
+}
+
+// mergeProjects folds newly-generated services/volumes/networks into an
+// existing project. For services that already exist, fields a user is
+// likely to have hand-authored (build context, custom labels, healthchecks,
+// profiles) are preserved rather than clobbered by what we just inspected;
+// the rest of those services, and any new service, comes from the fresh
+// generation. Volumes and networks already in the existing project are kept
+// as they are; generated ones are only added under names it doesn't have yet.
+func mergeProjects(existing, generated types.Project) types.Project {
+	merged := existing
+
+	if merged.Services == nil {
+		merged.Services = types.Services{}
+	}
+	for name, svc := range generated.Services {
+		if prior, ok := merged.Services[name]; ok {
+			svc.Build = prior.Build
+			svc.Labels = mergeLabels(prior.Labels, svc.Labels)
+			svc.HealthCheck = prior.HealthCheck
+			svc.Profiles = prior.Profiles
+		}
+		merged.Services[name] = svc
+	}
+
+	if merged.Volumes == nil {
+		merged.Volumes = types.Volumes{}
+	}
+	for name, vol := range generated.Volumes {
+		if _, ok := merged.Volumes[name]; !ok {
+			merged.Volumes[name] = vol
+		}
+	}
+
+	if merged.Networks == nil {
+		merged.Networks = types.Networks{}
+	}
+	for name, net := range generated.Networks {
+		if _, ok := merged.Networks[name]; !ok {
+			merged.Networks[name] = net
+		}
+	}
+
+	return merged
+}
+
+func mergeLabels(prior, fresh types.Labels) types.Labels {
+	if len(prior) == 0 {
+		return fresh
+	}
+
+	merged := types.Labels{}
+	for k, v := range fresh {
+		merged[k] = v
+	}
+	for k, v := range prior {
+		merged[k] = v
+	}
+	return merged
+}
+
+// unifiedDiff renders a line-by-line diff between what's already on disk at
+// path and what --output is about to write.
+//
+// TODO: this walks both files index-by-index rather than computing an actual
+// LCS, so an inserted/deleted line shifts everything after it -- good enough
+// to eyeball what --merge changed, not meant to be fed to `patch`.
+func unifiedDiff(path string, before, after []byte) string {
+	beforeLines := strings.Split(string(before), "\n")
+	afterLines := strings.Split(string(after), "\n")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- a/%s\n", path)
+	fmt.Fprintf(&b, "+++ b/%s\n", path)
+
+	lines := len(beforeLines)
+	if len(afterLines) > lines {
+		lines = len(afterLines)
+	}
+	for i := 0; i < lines; i++ {
+		var from, to string
+		if i < len(beforeLines) {
+			from = beforeLines[i]
+		}
+		if i < len(afterLines) {
+			to = afterLines[i]
+		}
+		if from == to {
+			continue
+		}
+		if i < len(beforeLines) {
+			fmt.Fprintf(&b, "-%s\n", from)
+		}
+		if i < len(afterLines) {
+			fmt.Fprintf(&b, "+%s\n", to)
+		}
+	}
+
+	return b.String()
+}
+
+// formatProject renders the generated project in the requested output
+// format. "kube" doesn't go through compose-go at all -- it's translated
+// into the closest equivalent Kubernetes manifests instead.
+func formatProject(p types.Project, format string) ([]byte, error) {
+	switch format {
+	case "", "yaml":
+		out, err := p.MarshalYAML()
+		if err != nil {
+			return nil, fmt.Errorf("oops bad %w", err)
+		}
+		return out, nil
+	case "json":
+		out, err := p.MarshalJSON()
+		if err != nil {
+			return nil, fmt.Errorf("oops bad %w", err)
+		}
+		return out, nil
+	case "kube":
+		return marshalKubeManifests(p)
+	default:
+		return nil, fmt.Errorf("unsupported format %q: must be one of yaml, json, kube", format)
+	}
+}
+
 func getName(opts *generateOptions) string {
 	if opts.ProjectName != "" {
 		return opts.ProjectName
@@ -153,7 +666,7 @@ func getServiceName(c engineTypes.ContainerJSON, seed int) string {
 	return serviceName
 }
 
-func getServiceBindingsPorts(c engineTypes.ContainerJSON) ([]types.ServicePortConfig, types.StringOrNumberList) {
+func getServiceBindingsPorts(c engineTypes.ContainerJSON, defaults imageDefaults) ([]types.ServicePortConfig, types.StringOrNumberList) {
 	ports := []types.ServicePortConfig{}
 	portsBinding := map[string]bool{}
 
@@ -175,104 +688,530 @@ func getServiceBindingsPorts(c engineTypes.ContainerJSON) ([]types.ServicePortCo
 	exposedPorts := types.StringOrNumberList{}
 	for exposed := range c.Config.ExposedPorts {
 		// Make a list of the exposed ports, filtering out ports that are bound
-		// to the host
-		if _, ok := portsBinding[exposed.Port()]; !ok {
-			exposedPorts = append(exposedPorts, exposed.Port())
+		// to the host, and ports the image already exposes by default
+		if portsBinding[exposed.Port()] {
+			continue
 		}
-
+		if defaults.ExposedPorts[exposed.Port()] {
+			continue
+		}
+		exposedPorts = append(exposedPorts, exposed.Port())
 	}
 
 	return ports, exposedPorts
 }
 
-func getServiceEnv(c engineTypes.ContainerJSON) types.MappingWithEquals {
+func getServiceEnv(c engineTypes.ContainerJSON, defaults imageDefaults) types.MappingWithEquals {
 	// TODO: Test environment file as input to see how that data gets populated;
 	// there may not be anything additional I need to do here
-	return types.NewMappingWithEquals(c.Config.Env)
+	env := make([]string, 0, len(c.Config.Env))
+	for _, kv := range c.Config.Env {
+		if !defaults.Env[kv] {
+			env = append(env, kv)
+		}
+	}
+	return types.NewMappingWithEquals(env)
 }
 
-func getServiceEntrypoint(c engineTypes.ContainerJSON) types.ShellCommand {
-	// TODO: Entrypoint should only be specified when it differs from the image's entrypoint
-	// TODO: How to tell the difference between an empty entrypoint and one that isn't specified?
+func getServiceEntrypoint(c engineTypes.ContainerJSON, defaults imageDefaults) types.ShellCommand {
+	if stringSliceEqual(c.Config.Entrypoint, defaults.Entrypoint) {
+		return nil
+	}
 	return types.ShellCommand(c.Config.Entrypoint)
 }
 
-func getServiceCmd(c engineTypes.ContainerJSON) types.ShellCommand {
+func getServiceCmd(c engineTypes.ContainerJSON, defaults imageDefaults) types.ShellCommand {
+	if stringSliceEqual(c.Config.Cmd, defaults.Cmd) {
+		return nil
+	}
 	return types.ShellCommand(c.Config.Cmd)
 }
 
-func getServiceMounts(c engineTypes.ContainerJSON) []types.ServiceVolumeConfig {
-	mountsLen := len(c.HostConfig.Binds) + len(c.HostConfig.Mounts)
-	mounts := make([]types.ServiceVolumeConfig, 0, mountsLen)
+func stringSliceEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// getServiceMounts reads the container's actual runtime mounts (rather than
+// just the `--volume`/`--mount` flags it was started with) and splits them
+// into the per-service `volumes:` entries plus any named volumes that need
+// to be declared at the top level of the project so services can share them.
+func getServiceMounts(ctx context.Context, dockerCli command.Cli, c engineTypes.ContainerJSON) ([]types.ServiceVolumeConfig, map[string]types.VolumeConfig) {
+	mounts := make([]types.ServiceVolumeConfig, 0, len(c.Mounts))
+	namedVolumes := map[string]types.VolumeConfig{}
 
-	// binds array of strings in c.HostConfig.Binds
-	for _, bString := range c.HostConfig.Binds {
-		options := strings.Split(bString, ":")
-		if len(options) < 2 {
-			// TODO: handle this case properly
-			fmt.Printf("unable to process bind mount: %s", bString)
+	for _, m := range c.Mounts {
+		switch m.Type {
+		case mount.TypeVolume:
+			// a named (or anonymous) volume -- promote it to the top-level
+			// `volumes:` map so it can be shared across services, and just
+			// reference it by name here
+			mounts = append(mounts, types.ServiceVolumeConfig{
+				Type:     "volume",
+				Source:   m.Name,
+				Target:   m.Destination,
+				ReadOnly: !m.RW,
+			})
+			if _, ok := namedVolumes[m.Name]; !ok {
+				namedVolumes[m.Name] = getVolumeConfig(ctx, dockerCli, m.Name, m.Driver)
+			}
+		case mount.TypeBind:
+			mounts = append(mounts, types.ServiceVolumeConfig{
+				Type:     "bind",
+				Source:   m.Source,
+				Target:   m.Destination,
+				ReadOnly: !m.RW,
+				Bind: &types.ServiceVolumeBind{
+					Propagation: string(m.Propagation),
+				},
+			})
+		case mount.TypeTmpfs:
+			mounts = append(mounts, types.ServiceVolumeConfig{
+				Type:     "tmpfs",
+				Target:   m.Destination,
+				ReadOnly: !m.RW,
+			})
+		default:
+			// TODO: npipe mounts, anything else docker supports
+			mounts = append(mounts, types.ServiceVolumeConfig{
+				Type:     string(m.Type),
+				Source:   m.Source,
+				Target:   m.Destination,
+				ReadOnly: !m.RW,
+			})
+		}
+	}
+
+	return mounts, namedVolumes
+}
+
+// getVolumeConfig inspects a named volume so the top-level `volumes:` entry
+// carries its real driver/driver_opts/labels instead of just its name.
+func getVolumeConfig(ctx context.Context, dockerCli command.Cli, name, fallbackDriver string) types.VolumeConfig {
+	cfg := types.VolumeConfig{Name: name, Driver: fallbackDriver}
+
+	vol, err := dockerCli.Client().VolumeInspect(ctx, name)
+	if err != nil {
+		// the volume may have disappeared since the container was inspected --
+		// fall back to what we already know rather than failing the whole generate
+		fmt.Fprintf(os.Stderr, "warning: failed to inspect volume %q, some of its config will be missing: %v\n", name, err)
+		return cfg
+	}
+
+	cfg.Driver = vol.Driver
+	cfg.DriverOpts = vol.Options
+	if len(vol.Labels) > 0 {
+		cfg.Labels = types.Labels(vol.Labels)
+	}
+
+	return cfg
+}
+
+// getServiceNetworks maps a container's attached networks to the service's
+// `networks:` references, and promotes any non-default network to a
+// top-level `networks:` entry so multi-container setups round-trip.
+func getServiceNetworks(ctx context.Context, dockerCli command.Cli, c engineTypes.ContainerJSON) (map[string]*types.ServiceNetworkConfig, map[string]types.NetworkConfig) {
+	serviceNetworks := map[string]*types.ServiceNetworkConfig{}
+	namedNetworks := map[string]types.NetworkConfig{}
+
+	if c.NetworkSettings == nil {
+		return serviceNetworks, namedNetworks
+	}
+
+	for name := range c.NetworkSettings.Networks {
+		if defaultNetworkNames[name] {
 			continue
 		}
 
-		// TODO: The source of this might be a volume and not a host folder
-		// I'm not sure the canonical way to structure / reference these
-		bind := types.ServiceVolumeConfig{
-			Type:     "bind",
-			Source:   options[0],
-			Target:   options[1],
-			ReadOnly: true,
+		serviceNetworks[name] = &types.ServiceNetworkConfig{}
+		if _, ok := namedNetworks[name]; !ok {
+			namedNetworks[name] = getNetworkConfig(ctx, dockerCli, name)
+		}
+	}
+
+	return serviceNetworks, namedNetworks
+}
+
+// getNetworkConfig inspects a non-default network so the top-level
+// `networks:` entry carries its real driver/IPAM config, and is marked
+// `external: true` when it wasn't created by a compose project -- otherwise
+// `docker compose up` on the generated file would try to create it itself
+// and could collide with, or diverge from, the real network.
+func getNetworkConfig(ctx context.Context, dockerCli command.Cli, name string) types.NetworkConfig {
+	cfg := types.NetworkConfig{Name: name}
+
+	nr, err := dockerCli.Client().NetworkInspect(ctx, name, engineTypes.NetworkInspectOptions{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to inspect network %q, some of its config will be missing: %v\n", name, err)
+		return cfg
+	}
+
+	cfg.Driver = nr.Driver
+	cfg.DriverOpts = nr.Options
+	cfg.Internal = nr.Internal
+	cfg.Attachable = nr.Attachable
+	if len(nr.Labels) > 0 {
+		cfg.Labels = types.Labels(nr.Labels)
+	}
+
+	ipam := types.IPAMConfig{Driver: nr.IPAM.Driver}
+	for _, pool := range nr.IPAM.Config {
+		ipam.Config = append(ipam.Config, &types.IPAMPool{
+			Subnet:             pool.Subnet,
+			Gateway:            pool.Gateway,
+			IPRange:            pool.IPRange,
+			AuxiliaryAddresses: pool.AuxAddress,
+		})
+	}
+	if ipam.Driver != "" || len(ipam.Config) > 0 {
+		cfg.Ipam = ipam
+	}
+
+	if _, ownedByCompose := nr.Labels["com.docker.compose.network"]; !ownedByCompose {
+		cfg.External = types.External(true)
+	}
+
+	return cfg
+}
+
+func getServiceImage(c engineTypes.ContainerJSON) string {
+	// hehe this is extremely hand-wavy and won't work in that many cases.
+	// The Config.Image is the image reference that the container was run with
+	return c.Config.Image
+}
+
+// imageDefaults is the subset of an image's own Config that a container can
+// inherit without the user ever having overridden it on the CLI. We diff
+// against this so generate doesn't repeat the image's own defaults.
+type imageDefaults struct {
+	Entrypoint   []string
+	Cmd          []string
+	Env          map[string]bool
+	ExposedPorts map[string]bool
+	WorkingDir   string
+	User         string
+	Labels       map[string]string
+}
+
+// getImageDefaults inspects the image a container was created from, so the
+// get* functions above can skip emitting anything that's just the image
+// talking, not the container.
+func getImageDefaults(ctx context.Context, dockerCli command.Cli, c engineTypes.ContainerJSON) (imageDefaults, error) {
+	defaults := imageDefaults{
+		Env:          map[string]bool{},
+		ExposedPorts: map[string]bool{},
+	}
+
+	ref := c.Image
+	if ref == "" {
+		ref = c.Config.Image
+	}
+
+	img, _, err := dockerCli.Client().ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return defaults, err
+	}
+	if img.Config == nil {
+		return defaults, nil
+	}
+
+	defaults.Entrypoint = img.Config.Entrypoint
+	defaults.Cmd = img.Config.Cmd
+	defaults.WorkingDir = img.Config.WorkingDir
+	defaults.User = img.Config.User
+	defaults.Labels = img.Config.Labels
+	for _, kv := range img.Config.Env {
+		defaults.Env[kv] = true
+	}
+	for exposed := range img.Config.ExposedPorts {
+		defaults.ExposedPorts[exposed.Port()] = true
+	}
+
+	return defaults, nil
+}
+
+// diffString returns containerValue unless it's just repeating what the
+// image already sets by default.
+func diffString(containerValue, imageValue string) string {
+	if containerValue == imageValue {
+		return ""
+	}
+	return containerValue
+}
+
+// diffLabels returns the labels a container adds or overrides on top of
+// whatever its image already labels it with.
+func diffLabels(containerLabels, imageLabels map[string]string) types.Labels {
+	if len(containerLabels) == 0 {
+		return nil
+	}
+
+	labels := types.Labels{}
+	for k, v := range containerLabels {
+		if imageLabels[k] == v {
+			continue
 		}
-		// TODO: I'm not sure if this is the proper way to map this?
-		if len(options) == 3 && options[2] == "rw" {
-			bind.ReadOnly = false
+		labels[k] = v
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// getServiceHealthcheck isn't diffed against the image -- a Healthcheck a
+// user explicitly reproduced on the CLI is worth keeping explicit too.
+func getServiceHealthcheck(c engineTypes.ContainerJSON) *types.HealthCheckConfig {
+	hc := c.Config.Healthcheck
+	if hc == nil || (len(hc.Test) == 0 && hc.Interval == 0 && hc.Timeout == 0 && hc.StartPeriod == 0 && hc.Retries == 0) {
+		return nil
+	}
+
+	check := &types.HealthCheckConfig{
+		Test: types.HealthCheckTest(hc.Test),
+	}
+	if hc.Interval != 0 {
+		check.Interval = durationPtr(hc.Interval)
+	}
+	if hc.Timeout != 0 {
+		check.Timeout = durationPtr(hc.Timeout)
+	}
+	if hc.StartPeriod != 0 {
+		check.StartPeriod = durationPtr(hc.StartPeriod)
+	}
+	if hc.Retries != 0 {
+		retries := uint64(hc.Retries)
+		check.Retries = &retries
+	}
+
+	return check
+}
+
+func durationPtr(d time.Duration) *types.Duration {
+	v := types.Duration(d)
+	return &v
+}
+
+func getServiceDevices(c engineTypes.ContainerJSON) []types.DeviceMapping {
+	var devices []types.DeviceMapping
+	for _, d := range c.HostConfig.Devices {
+		devices = append(devices, types.DeviceMapping{
+			Source:      d.PathOnHost,
+			Target:      d.PathInContainer,
+			Permissions: d.CgroupPermissions,
+		})
+	}
+	return devices
+}
+
+func getServiceUlimits(c engineTypes.ContainerJSON) map[string]*types.UlimitsConfig {
+	if len(c.HostConfig.Ulimits) == 0 {
+		return nil
+	}
+
+	ulimits := map[string]*types.UlimitsConfig{}
+	for _, u := range c.HostConfig.Ulimits {
+		cfg := &types.UlimitsConfig{}
+		if u.Soft == u.Hard {
+			cfg.Single = int(u.Soft)
+		} else {
+			cfg.Soft = int(u.Soft)
+			cfg.Hard = int(u.Hard)
 		}
+		ulimits[u.Name] = cfg
+	}
+	return ulimits
+}
 
-		// TODO: There are probably other things / defaults that need to be mapped properly,
-		// following the .String() method on this return type!
-		mounts = append(mounts, bind)
+func getServiceLogging(c engineTypes.ContainerJSON) *types.LoggingConfig {
+	if c.HostConfig.LogConfig.Type == "" {
+		return nil
+	}
+	return &types.LoggingConfig{
+		Driver:  c.HostConfig.LogConfig.Type,
+		Options: c.HostConfig.LogConfig.Config,
 	}
+}
+
+// marshalKubeManifests translates a compose project into the Kubernetes
+// manifests that get it closest to running the same thing: a Pod or
+// Deployment per service, plus a Service for anything that publishes ports.
+// It's the `generate` equivalent of `podman generate kube`.
+func marshalKubeManifests(p types.Project) ([]byte, error) {
+	// sort the names so re-running generate against the same containers
+	// doesn't shuffle the output
+	names := make([]string, 0, len(p.Services))
+	for name := range p.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	// list of mount structs in c.HostConfig.Mounts
-	for _, m := range c.HostConfig.Mounts {
-		mount := types.ServiceVolumeConfig{
-			Type:        string(m.Type),
-			Source:      m.Source,
-			Target:      m.Target,
-			ReadOnly:    m.ReadOnly,
-			Consistency: string(m.Consistency),
+	var docs [][]byte
+	for _, name := range names {
+		svc := p.Services[name]
+		labels := map[string]string{"app": name}
+
+		workload, err := kubeyaml.Marshal(kubeWorkloadForService(name, svc, labels))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %q to a kube manifest: %w", name, err)
 		}
-		if m.BindOptions != nil {
-			mount.Bind = &types.ServiceVolumeBind{
-				Propagation:    string(m.BindOptions.Propagation),
-				CreateHostPath: m.BindOptions.CreateMountpoint,
-				// selinux = > does this map?
-				// extensions => does this map?
+		docs = append(docs, workload)
+
+		if kubeService := kubeServiceForService(name, svc, labels); kubeService != nil {
+			doc, err := kubeyaml.Marshal(kubeService)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal %q's service to a kube manifest: %w", name, err)
 			}
+			docs = append(docs, doc)
 		}
-		if m.VolumeOptions != nil {
-			mount.Volume = &types.ServiceVolumeVolume{
-				NoCopy:  m.VolumeOptions.NoCopy,
-				Subpath: m.VolumeOptions.Subpath,
-				// extensions => does this map?
-			}
+	}
+
+	return bytes.Join(docs, []byte("---\n")), nil
+}
+
+// kubeWorkloadForService picks between a bare Pod and a Deployment: an
+// explicit one-shot/on-failure restart policy can only be expressed on a
+// Pod, since a Deployment always restarts its pods for you.
+func kubeWorkloadForService(name string, svc types.ServiceConfig, labels map[string]string) interface{} {
+	podSpec := kubePodSpec(name, svc)
+
+	if policy, ok := kubeRestartPolicy(svc.Restart); ok {
+		podSpec.RestartPolicy = policy
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+			Spec:       podSpec,
 		}
-		if m.TmpfsOptions != nil {
-			mount.Tmpfs = &types.ServiceVolumeTmpfs{
-				Size: types.UnitBytes(m.TmpfsOptions.SizeBytes),
-				Mode: uint32(m.TmpfsOptions.Mode),
-				// extensions => does this map?
-			}
+	}
+
+	replicas := int32(1)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       podSpec,
+			},
+		},
+	}
+}
+
+// kubeRestartPolicy maps a compose restart policy to its Kubernetes
+// equivalent. "always"/"unless-stopped" (and the unset default) are better
+// expressed as a Deployment, so only the other two return an explicit policy.
+func kubeRestartPolicy(restart string) (corev1.RestartPolicy, bool) {
+	switch restart {
+	case "no":
+		return corev1.RestartPolicyNever, true
+	case "on-failure":
+		return corev1.RestartPolicyOnFailure, true
+	default:
+		return "", false
+	}
+}
+
+func kubePodSpec(name string, svc types.ServiceConfig) corev1.PodSpec {
+	container := corev1.Container{
+		Name:  name,
+		Image: svc.Image,
+	}
+	if len(svc.Entrypoint) > 0 {
+		container.Command = []string(svc.Entrypoint)
+	}
+	if len(svc.Command) > 0 {
+		container.Args = []string(svc.Command)
+	}
+
+	// sort the keys so re-running generate against the same containers
+	// doesn't shuffle the output, same as the service names above
+	envKeys := make([]string, 0, len(svc.Environment))
+	for k := range svc.Environment {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+	for _, k := range envKeys {
+		if v := svc.Environment[k]; v != nil {
+			container.Env = append(container.Env, corev1.EnvVar{Name: k, Value: *v})
+		}
+	}
+
+	seenPorts := map[uint32]bool{}
+	for _, p := range svc.Ports {
+		if seenPorts[p.Target] {
+			continue
 		}
-		mounts = append(mounts, mount)
+		seenPorts[p.Target] = true
+		container.Ports = append(container.Ports, corev1.ContainerPort{ContainerPort: int32(p.Target)})
 	}
 
-	// TODO: some of this data is going to be better served in a separate volumes declaration
+	var volumes []corev1.Volume
+	for i, v := range svc.Volumes {
+		volumeName := fmt.Sprintf("%s-vol-%d", name, i)
+
+		var source corev1.VolumeSource
+		switch v.Type {
+		case "bind":
+			source = corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: v.Source}}
+		case "volume":
+			// TODO: the PVC itself needs to be created/applied separately --
+			// we just reference it here by the volume's name
+			source = corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: v.Source}}
+		case "tmpfs":
+			source = corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}}
+		default:
+			fmt.Fprintf(os.Stderr, "warning: skipping %s mount at %q, unsupported by --format kube\n", v.Type, v.Target)
+			continue
+		}
+
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      volumeName,
+			MountPath: v.Target,
+			ReadOnly:  v.ReadOnly,
+		})
+		volumes = append(volumes, corev1.Volume{Name: volumeName, VolumeSource: source})
+	}
 
-	return mounts
+	return corev1.PodSpec{
+		Containers: []corev1.Container{container},
+		Volumes:    volumes,
+	}
 }
 
-func getServiceImage(c engineTypes.ContainerJSON) string {
-	// hehe this is extremely hand-wavy and won't work in that many cases.
-	// The Config.Image is the image reference that the container was run with
-	return c.Config.Image
+// kubeServiceForService builds the Service that fronts a workload, if it
+// actually publishes anything -- a compose service with no ports has
+// nothing for a Kubernetes Service to route to.
+func kubeServiceForService(name string, svc types.ServiceConfig, labels map[string]string) *corev1.Service {
+	if len(svc.Ports) == 0 {
+		return nil
+	}
+
+	var ports []corev1.ServicePort
+	seenPorts := map[uint32]bool{}
+	for _, p := range svc.Ports {
+		if seenPorts[p.Target] {
+			continue
+		}
+		seenPorts[p.Target] = true
+		ports = append(ports, corev1.ServicePort{
+			Name:       fmt.Sprintf("%d", p.Target),
+			Port:       int32(p.Target),
+			TargetPort: intstr.FromInt(int(p.Target)),
+		})
+	}
+
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports:    ports,
+		},
+	}
 }
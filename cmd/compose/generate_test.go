@@ -0,0 +1,560 @@
+/*
+   Copyright 2020 Docker Compose CLI authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compose
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/compose-spec/compose-go/v2/types"
+	"github.com/docker/cli/cli/command"
+	engineTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeAPIClient stubs just enough of client.APIClient for containerGroup's
+// ContainerInspect calls, panicking on anything else it's not set up for.
+type fakeAPIClient struct {
+	client.APIClient
+	containers map[string]engineTypes.ContainerJSON
+}
+
+func (f *fakeAPIClient) ContainerInspect(_ context.Context, ref string) (engineTypes.ContainerJSON, error) {
+	c, ok := f.containers[ref]
+	if !ok {
+		return engineTypes.ContainerJSON{}, fmt.Errorf("no such container: %s", ref)
+	}
+	return c, nil
+}
+
+// fakeCli stubs just enough of command.Cli to hand a containerGroup a
+// fakeAPIClient.
+type fakeCli struct {
+	command.Cli
+	client client.APIClient
+}
+
+func (f *fakeCli) Client() client.APIClient { return f.client }
+
+func newTestContainer(id, name string) engineTypes.ContainerJSON {
+	return engineTypes.ContainerJSON{
+		ContainerJSONBase: &engineTypes.ContainerJSONBase{
+			ID:         id,
+			Name:       "/" + name,
+			HostConfig: &container.HostConfig{},
+		},
+	}
+}
+
+func TestMergeProjects(t *testing.T) {
+	existing := types.Project{
+		Services: types.Services{
+			"web": types.ServiceConfig{
+				Name:     "web",
+				Image:    "old-image",
+				Build:    &types.BuildConfig{Context: "./web"},
+				Labels:   types.Labels{"custom": "keep-me"},
+				Profiles: []string{"prod"},
+			},
+		},
+		Volumes: types.Volumes{
+			"data": types.VolumeConfig{Name: "data", Driver: "local"},
+		},
+	}
+	generated := types.Project{
+		Services: types.Services{
+			"web": types.ServiceConfig{
+				Name:   "web",
+				Image:  "new-image",
+				Labels: types.Labels{"generated": "yes"},
+			},
+			"db": types.ServiceConfig{Name: "db", Image: "postgres"},
+		},
+		Volumes: types.Volumes{
+			"data": types.VolumeConfig{Name: "data", Driver: "nfs"},
+			"logs": types.VolumeConfig{Name: "logs", Driver: "local"},
+		},
+	}
+
+	merged := mergeProjects(existing, generated)
+
+	web := merged.Services["web"]
+	if web.Image != "new-image" {
+		t.Errorf("web.Image = %q, want freshly-generated %q", web.Image, "new-image")
+	}
+	if web.Build == nil || web.Build.Context != "./web" {
+		t.Errorf("web.Build = %+v, want preserved hand-authored build context", web.Build)
+	}
+	if web.Labels["custom"] != "keep-me" {
+		t.Errorf("web.Labels[custom] = %q, want preserved %q", web.Labels["custom"], "keep-me")
+	}
+	if len(web.Profiles) != 1 || web.Profiles[0] != "prod" {
+		t.Errorf("web.Profiles = %v, want preserved [prod]", web.Profiles)
+	}
+
+	if _, ok := merged.Services["db"]; !ok {
+		t.Error("merged.Services is missing the newly-generated \"db\" key")
+	}
+
+	if merged.Volumes["data"].Driver != "local" {
+		t.Errorf("merged.Volumes[data].Driver = %q, want existing %q preserved", merged.Volumes["data"].Driver, "local")
+	}
+	if _, ok := merged.Volumes["logs"]; !ok {
+		t.Error("merged.Volumes is missing the newly-generated \"logs\" key")
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	tests := []struct {
+		name  string
+		prior types.Labels
+		fresh types.Labels
+		want  types.Labels
+	}{
+		{
+			name:  "no prior labels keeps fresh as-is",
+			prior: nil,
+			fresh: types.Labels{"a": "1"},
+			want:  types.Labels{"a": "1"},
+		},
+		{
+			name:  "prior wins on conflicting keys",
+			prior: types.Labels{"a": "hand-authored"},
+			fresh: types.Labels{"a": "generated"},
+			want:  types.Labels{"a": "hand-authored"},
+		},
+		{
+			name:  "keys unique to either side survive",
+			prior: types.Labels{"only-prior": "1"},
+			fresh: types.Labels{"only-fresh": "2"},
+			want:  types.Labels{"only-prior": "1", "only-fresh": "2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeLabels(tt.prior, tt.fresh)
+			if len(got) != len(tt.want) {
+				t.Fatalf("mergeLabels() = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("mergeLabels()[%q] = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	before := []byte("image: old\nports:\n- 80\n")
+	after := []byte("image: new\nports:\n- 80\n")
+
+	diff := unifiedDiff("compose.yaml", before, after)
+
+	if !strings.Contains(diff, "--- a/compose.yaml") || !strings.Contains(diff, "+++ b/compose.yaml") {
+		t.Fatalf("unifiedDiff() missing file headers:\n%s", diff)
+	}
+	if !strings.Contains(diff, "-image: old") {
+		t.Errorf("unifiedDiff() missing removed line, got:\n%s", diff)
+	}
+	if !strings.Contains(diff, "+image: new") {
+		t.Errorf("unifiedDiff() missing added line, got:\n%s", diff)
+	}
+	if strings.Contains(diff, "-ports:") || strings.Contains(diff, "+ports:") {
+		t.Errorf("unifiedDiff() emitted an unchanged line, got:\n%s", diff)
+	}
+}
+
+func TestUnifiedDiffAgainstMissingFile(t *testing.T) {
+	diff := unifiedDiff("compose.yaml", nil, []byte("image: new\n"))
+
+	if !strings.Contains(diff, "+image: new") {
+		t.Errorf("unifiedDiff() against an empty/missing file should show every line as added, got:\n%s", diff)
+	}
+}
+
+func TestStringSliceEqual(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+		want bool
+	}{
+		{name: "equal", a: []string{"a", "b"}, b: []string{"a", "b"}, want: true},
+		{name: "different order", a: []string{"a", "b"}, b: []string{"b", "a"}, want: false},
+		{name: "different length", a: []string{"a"}, b: []string{"a", "b"}, want: false},
+		{name: "both empty", a: []string{}, b: []string{}, want: true},
+		{name: "both nil", a: nil, b: nil, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stringSliceEqual(tt.a, tt.b); got != tt.want {
+				t.Errorf("stringSliceEqual(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffString(t *testing.T) {
+	tests := []struct {
+		name           string
+		containerValue string
+		imageValue     string
+		want           string
+	}{
+		{name: "same as image default", containerValue: "/bin/sh", imageValue: "/bin/sh", want: ""},
+		{name: "overridden on the container", containerValue: "/bin/bash", imageValue: "/bin/sh", want: "/bin/bash"},
+		{name: "both empty", containerValue: "", imageValue: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffString(tt.containerValue, tt.imageValue); got != tt.want {
+				t.Errorf("diffString(%q, %q) = %q, want %q", tt.containerValue, tt.imageValue, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffLabels(t *testing.T) {
+	tests := []struct {
+		name            string
+		containerLabels map[string]string
+		imageLabels     map[string]string
+		want            types.Labels
+	}{
+		{
+			name:            "no container labels",
+			containerLabels: nil,
+			imageLabels:     map[string]string{"com.example.image": "v1"},
+			want:            nil,
+		},
+		{
+			name:            "container label matches image default, dropped",
+			containerLabels: map[string]string{"com.example.image": "v1"},
+			imageLabels:     map[string]string{"com.example.image": "v1"},
+			want:            nil,
+		},
+		{
+			name:            "container label overrides image default, kept",
+			containerLabels: map[string]string{"com.example.image": "v2"},
+			imageLabels:     map[string]string{"com.example.image": "v1"},
+			want:            types.Labels{"com.example.image": "v2"},
+		},
+		{
+			name:            "container-only label kept",
+			containerLabels: map[string]string{"com.example.custom": "yes"},
+			imageLabels:     nil,
+			want:            types.Labels{"com.example.custom": "yes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffLabels(tt.containerLabels, tt.imageLabels)
+			if len(got) != len(tt.want) {
+				t.Fatalf("diffLabels() = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("diffLabels()[%q] = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			name: "single filter",
+			raw:  []string{"label=com.example=yes"},
+			want: map[string][]string{"label": {"com.example=yes"}},
+		},
+		{
+			name: "multiple filters",
+			raw:  []string{"status=running", "label=com.example=yes"},
+			want: map[string][]string{"status": {"running"}, "label": {"com.example=yes"}},
+		},
+		{
+			name: "no filters",
+			raw:  nil,
+			want: map[string][]string{},
+		},
+		{
+			name:    "missing equals sign",
+			raw:     []string{"status"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFilters(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseFilters(%v) error = nil, want an error", tt.raw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFilters(%v) unexpected error: %v", tt.raw, err)
+			}
+			for key, values := range tt.want {
+				for _, value := range values {
+					if !got.ExactMatch(key, value) {
+						t.Errorf("parseFilters(%v) missing %s=%s", tt.raw, key, value)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSharesNetwork(t *testing.T) {
+	tests := []struct {
+		name string
+		a    map[string]bool
+		b    map[string]bool
+		want bool
+	}{
+		{name: "shared network", a: map[string]bool{"mynet": true}, b: map[string]bool{"mynet": true, "other": true}, want: true},
+		{name: "disjoint networks", a: map[string]bool{"mynet": true}, b: map[string]bool{"other": true}, want: false},
+		{name: "a empty", a: map[string]bool{}, b: map[string]bool{"mynet": true}, want: false},
+		{name: "both empty", a: map[string]bool{}, b: map[string]bool{}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sharesNetwork(tt.a, tt.b); got != tt.want {
+				t.Errorf("sharesNetwork(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveRelations(t *testing.T) {
+	web := newTestContainer("web-id", "web")
+	db := newTestContainer("db-id", "db")
+	web.HostConfig.Links = []string{"/db:/web/db"}
+	web.HostConfig.VolumesFrom = []string{"db-id:ro"}
+
+	group := newContainerGroup(context.Background(), &fakeCli{client: &fakeAPIClient{
+		containers: map[string]engineTypes.ContainerJSON{
+			"web-id": web,
+			"db-id":  db,
+			"db":     db,
+		},
+	}})
+
+	if _, err := group.inspect("web-id"); err != nil {
+		t.Fatalf("inspect(web-id) failed: %v", err)
+	}
+
+	rel, err := group.resolveRelations(web)
+	if err != nil {
+		t.Fatalf("resolveRelations() failed: %v", err)
+	}
+
+	if len(rel.Links) != 1 || rel.Links[0] != "db" {
+		t.Errorf("rel.Links = %v, want [db]", rel.Links)
+	}
+	if len(rel.VolumesFrom) != 1 || rel.VolumesFrom[0] != "db:ro" {
+		t.Errorf("rel.VolumesFrom = %v, want [db:ro]", rel.VolumesFrom)
+	}
+	if _, ok := rel.DependsOn["db"]; !ok {
+		t.Errorf("rel.DependsOn = %v, want an entry for db", rel.DependsOn)
+	}
+}
+
+func TestResolveRelationsLinkAlias(t *testing.T) {
+	web := newTestContainer("web-id", "web")
+	db := newTestContainer("db-id", "db")
+	web.HostConfig.Links = []string{"/db:/web/database"}
+
+	group := newContainerGroup(context.Background(), &fakeCli{client: &fakeAPIClient{
+		containers: map[string]engineTypes.ContainerJSON{
+			"web-id": web,
+			"db-id":  db,
+			"db":     db,
+		},
+	}})
+
+	if _, err := group.inspect("web-id"); err != nil {
+		t.Fatalf("inspect(web-id) failed: %v", err)
+	}
+
+	rel, err := group.resolveRelations(web)
+	if err != nil {
+		t.Fatalf("resolveRelations() failed: %v", err)
+	}
+
+	if len(rel.Links) != 1 || rel.Links[0] != "db:database" {
+		t.Errorf("rel.Links = %v, want [db:database]", rel.Links)
+	}
+}
+
+func TestResolveRelationsNetworkMode(t *testing.T) {
+	web := newTestContainer("web-id", "web")
+	db := newTestContainer("db-id", "db")
+	web.HostConfig.NetworkMode = "container:db-id"
+
+	group := newContainerGroup(context.Background(), &fakeCli{client: &fakeAPIClient{
+		containers: map[string]engineTypes.ContainerJSON{
+			"web-id": web,
+			"db-id":  db,
+		},
+	}})
+
+	if _, err := group.inspect("web-id"); err != nil {
+		t.Fatalf("inspect(web-id) failed: %v", err)
+	}
+
+	rel, err := group.resolveRelations(web)
+	if err != nil {
+		t.Fatalf("resolveRelations() failed: %v", err)
+	}
+
+	if rel.NetworkMode != "service:db" {
+		t.Errorf("rel.NetworkMode = %q, want %q", rel.NetworkMode, "service:db")
+	}
+	if _, ok := rel.DependsOn["db"]; !ok {
+		t.Errorf("rel.DependsOn = %v, want an entry for db", rel.DependsOn)
+	}
+}
+
+func TestInferNetworkDependencies(t *testing.T) {
+	web := newTestContainer("web-id", "web")
+	db := newTestContainer("db-id", "db")
+	web.NetworkSettings = &engineTypes.NetworkSettings{
+		Networks: map[string]*network.EndpointSettings{"mynet": {}},
+	}
+	db.NetworkSettings = &engineTypes.NetworkSettings{
+		Networks: map[string]*network.EndpointSettings{"mynet": {}},
+	}
+
+	group := newContainerGroup(context.Background(), &fakeCli{client: &fakeAPIClient{
+		containers: map[string]engineTypes.ContainerJSON{
+			"db-id":  db,
+			"web-id": web,
+		},
+	}})
+	if _, err := group.inspect("db-id"); err != nil {
+		t.Fatalf("inspect(db-id) failed: %v", err)
+	}
+	if _, err := group.inspect("web-id"); err != nil {
+		t.Fatalf("inspect(web-id) failed: %v", err)
+	}
+
+	relations := map[string]containerRelations{
+		"db-id":  {},
+		"web-id": {},
+	}
+	group.inferNetworkDependencies([]string{"db-id", "web-id"}, relations)
+
+	if _, ok := relations["web-id"].DependsOn["db"]; !ok {
+		t.Errorf("relations[web-id].DependsOn = %v, want an entry for db (shares mynet, inspected first)", relations["web-id"].DependsOn)
+	}
+	if len(relations["db-id"].DependsOn) != 0 {
+		t.Errorf("relations[db-id].DependsOn = %v, want empty -- it was inspected first", relations["db-id"].DependsOn)
+	}
+}
+
+func TestKubeRestartPolicy(t *testing.T) {
+	tests := []struct {
+		restart    string
+		wantPolicy corev1.RestartPolicy
+		wantOK     bool
+	}{
+		{restart: "no", wantPolicy: corev1.RestartPolicyNever, wantOK: true},
+		{restart: "on-failure", wantPolicy: corev1.RestartPolicyOnFailure, wantOK: true},
+		{restart: "always", wantOK: false},
+		{restart: "unless-stopped", wantOK: false},
+		{restart: "", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.restart, func(t *testing.T) {
+			policy, ok := kubeRestartPolicy(tt.restart)
+			if ok != tt.wantOK {
+				t.Fatalf("kubeRestartPolicy(%q) ok = %v, want %v", tt.restart, ok, tt.wantOK)
+			}
+			if ok && policy != tt.wantPolicy {
+				t.Fatalf("kubeRestartPolicy(%q) = %v, want %v", tt.restart, policy, tt.wantPolicy)
+			}
+		})
+	}
+}
+
+func TestKubeWorkloadForService(t *testing.T) {
+	tests := []struct {
+		name    string
+		restart string
+		want    string // "Pod" or "Deployment"
+	}{
+		{name: "one-shot", restart: "no", want: "Pod"},
+		{name: "retry-on-failure", restart: "on-failure", want: "Pod"},
+		{name: "long-running-default", restart: "", want: "Deployment"},
+		{name: "long-running-always", restart: "always", want: "Deployment"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := types.ServiceConfig{Restart: tt.restart}
+			workload := kubeWorkloadForService("web", svc, map[string]string{"app": "web"})
+
+			switch tt.want {
+			case "Pod":
+				if _, ok := workload.(*corev1.Pod); !ok {
+					t.Fatalf("kubeWorkloadForService() = %T, want *corev1.Pod", workload)
+				}
+			case "Deployment":
+				if _, ok := workload.(*appsv1.Deployment); !ok {
+					t.Fatalf("kubeWorkloadForService() = %T, want *appsv1.Deployment", workload)
+				}
+			}
+		})
+	}
+}
+
+func TestKubeServiceForServiceDedupesPorts(t *testing.T) {
+	svc := types.ServiceConfig{
+		Ports: []types.ServicePortConfig{
+			{Target: 80, Published: "8080", HostIP: "127.0.0.1"},
+			{Target: 80, Published: "8080", HostIP: "0.0.0.0"},
+		},
+	}
+
+	kubeService := kubeServiceForService("web", svc, map[string]string{"app": "web"})
+
+	if len(kubeService.Spec.Ports) != 1 {
+		t.Fatalf("kubeService.Spec.Ports = %v, want 1 deduped entry", kubeService.Spec.Ports)
+	}
+}